@@ -0,0 +1,74 @@
+package prometheus
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuthKeyDiffersAcrossProfiles(t *testing.T) {
+	base := &authConfig{basicAuthUser: "alice", basicAuthPassword: "secret"}
+
+	cases := []struct {
+		name string
+		ac   *authConfig
+	}{
+		{"different user", &authConfig{basicAuthUser: "bob", basicAuthPassword: "secret"}},
+		{"different password", &authConfig{basicAuthUser: "alice", basicAuthPassword: "other"}},
+		{"bearer token instead", &authConfig{bearerToken: "token123"}},
+		{"different tls ca", &authConfig{basicAuthUser: "alice", basicAuthPassword: "secret", tlsCAFile: "/etc/ca.pem"}},
+		{"insecure skip verify", &authConfig{basicAuthUser: "alice", basicAuthPassword: "secret", tlsInsecureSkipVerify: true}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if base.authKey() == c.ac.authKey() {
+				t.Errorf("expected distinct auth profiles to hash differently")
+			}
+		})
+	}
+}
+
+func TestAuthKeyStableForIdenticalProfiles(t *testing.T) {
+	a := &authConfig{basicAuthUser: "alice", basicAuthPassword: "secret", tlsServerName: "example.com"}
+	b := &authConfig{basicAuthUser: "alice", basicAuthPassword: "secret", tlsServerName: "example.com"}
+
+	if a.authKey() != b.authKey() {
+		t.Errorf("expected identical auth profiles to hash the same")
+	}
+}
+
+func TestCertFilesChanged(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, []byte("pem"), 0o600); err != nil {
+		t.Fatalf("could not write test ca file: %v", err)
+	}
+
+	ac := &authConfig{tlsCAFile: caFile}
+
+	future := time.Now().Add(time.Hour)
+	if ac.certFilesChanged(future) {
+		t.Errorf("expected no change relative to a future timestamp")
+	}
+
+	past := time.Now().Add(-time.Hour)
+	if !ac.certFilesChanged(past) {
+		t.Errorf("expected the file's mtime to be after a past timestamp")
+	}
+}
+
+func TestCertFilesChangedMissingFilesAreIgnored(t *testing.T) {
+	ac := &authConfig{tlsCAFile: "/does/not/exist.pem"}
+	if ac.certFilesChanged(time.Now().Add(-time.Hour)) {
+		t.Errorf("expected a missing file to be ignored rather than reported as changed")
+	}
+}
+
+func TestCertFilesChangedNoFilesConfigured(t *testing.T) {
+	ac := &authConfig{}
+	if ac.certFilesChanged(time.Now().Add(-time.Hour)) {
+		t.Errorf("expected no configured files to never report a change")
+	}
+}
@@ -0,0 +1,154 @@
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+// dedupeWindow is how long after its previous occurrence (suppressed or not) an
+// identical error-or-above log record is suppressed, to avoid flooding logs when the
+// Pushgateway is down during the retry loop in Publish. A record that keeps repeating
+// within this window stays suppressed.
+const dedupeWindow = 30 * time.Second
+
+var (
+	loggerOnce  sync.Once
+	loggerLevel = new(slog.LevelVar)
+	baseLogger  *slog.Logger
+)
+
+// rootLogger returns the package-level logger, configuring its level and handler
+// (text or json, via the "log_format" config key) from config exactly once per
+// process, so concurrent publishes can't race each other's level by resetting it.
+func rootLogger(config map[string]ctypes.ConfigValue) *slog.Logger {
+	loggerOnce.Do(func() {
+		loggerLevel.Set(levelFromConfig(config))
+
+		opts := &slog.HandlerOptions{Level: loggerLevel}
+		var handler slog.Handler
+		if strings.ToLower(configString(config, "log_format")) == "json" {
+			handler = slog.NewJSONHandler(os.Stderr, opts)
+		} else {
+			handler = slog.NewTextHandler(os.Stderr, opts)
+		}
+
+		baseLogger = slog.New(newDedupeHandler(handler, dedupeWindow))
+	})
+
+	return baseLogger
+}
+
+func levelFromConfig(config map[string]ctypes.ConfigValue) slog.Level {
+	if configBool(config, "debug") {
+		return slog.LevelDebug
+	}
+
+	switch strings.ToLower(configString(config, "log-level")) {
+	case "debug":
+		return slog.LevelDebug
+	case "info":
+		return slog.LevelInfo
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelWarn
+	}
+}
+
+// getLogger returns a per-publish child logger carrying the plugin identity plus the
+// job/instance this call is publishing as. Callers that know the destination URL
+// (selectClient, sendMetrics, sendRemoteWriteMetrics) add a "url" attribute on top.
+func getLogger(config map[string]ctypes.ConfigValue) *slog.Logger {
+	return rootLogger(config).With(
+		"plugin-name", name,
+		"plugin-version", version,
+		"plugin-type", pluginType.String(),
+		"job", configString(config, "job"),
+		"instance", configString(config, "instance"),
+	)
+}
+
+// dedupeState is the suppression window state shared by a dedupeHandler and every
+// handler derived from it via With/WithGroup, so dedupe applies across all the
+// per-publish child loggers getLogger hands out, not just one goroutine's copy.
+type dedupeState struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	window time.Duration
+}
+
+func (s *dedupeState) shouldSuppress(r slog.Record, bound []slog.Attr) bool {
+	if r.Level < slog.LevelError {
+		return false
+	}
+
+	key := dedupeKey(r, bound)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last, seen := s.seen[key]
+	s.seen[key] = r.Time
+	return seen && r.Time.Sub(last) < s.window
+}
+
+// dedupeKey identifies a record for suppression purposes by its message plus every
+// attribute that would actually appear in its rendered line: both attrs bound earlier
+// in the chain via With (job/instance/url, which live on the handler and are invisible
+// to r.Attrs) and the attrs passed at the call site. Keying on the message alone would
+// dedupe, say, a Pushgateway connection error for one job/instance/url against an
+// unrelated one within the same window.
+func dedupeKey(r slog.Record, bound []slog.Attr) string {
+	var b strings.Builder
+	b.WriteString(r.Message)
+	for _, a := range bound {
+		fmt.Fprintf(&b, "|%s=%v", a.Key, a.Value)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		fmt.Fprintf(&b, "|%s=%v", a.Key, a.Value)
+		return true
+	})
+	return b.String()
+}
+
+// dedupeHandler wraps another slog.Handler and drops repeated identical error (or
+// higher) records seen again within its window. attrs accumulates everything bound via
+// WithAttrs on this handler's chain so dedupeKey can fold it in alongside the record's
+// own call-site attrs.
+type dedupeHandler struct {
+	slog.Handler
+	state *dedupeState
+	attrs []slog.Attr
+}
+
+func newDedupeHandler(h slog.Handler, window time.Duration) *dedupeHandler {
+	return &dedupeHandler{
+		Handler: h,
+		state:   &dedupeState{seen: make(map[string]time.Time), window: window},
+	}
+}
+
+func (d *dedupeHandler) Handle(ctx context.Context, r slog.Record) error {
+	if d.state.shouldSuppress(r, d.attrs) {
+		return nil
+	}
+	return d.Handler.Handle(ctx, r)
+}
+
+func (d *dedupeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	merged := make([]slog.Attr, len(d.attrs)+len(attrs))
+	copy(merged, d.attrs)
+	copy(merged[len(d.attrs):], attrs)
+	return &dedupeHandler{Handler: d.Handler.WithAttrs(attrs), state: d.state, attrs: merged}
+}
+
+func (d *dedupeHandler) WithGroup(name string) slog.Handler {
+	return &dedupeHandler{Handler: d.Handler.WithGroup(name), state: d.state, attrs: d.attrs}
+}
@@ -0,0 +1,201 @@
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+// metricType is a Prometheus/OpenMetrics metric type as emitted in a "# TYPE" line.
+type metricType string
+
+const (
+	metricTypeCounter metricType = "counter"
+	metricTypeGauge   metricType = "gauge"
+	metricTypeUntyped metricType = "untyped"
+
+	// prometheusTypeTag is the snap tag used to pin a metric's OpenMetrics type explicitly.
+	prometheusTypeTag = "prometheus_type"
+	// descriptionTag, when present, becomes the metric family's "# HELP" text.
+	descriptionTag = "description"
+)
+
+// typeMapping pairs a compiled regex with the metric type it implies, preserving the
+// order the pairs were declared in the "type_map" config so the first match wins.
+type typeMapping struct {
+	re    *regexp.Regexp
+	mtype metricType
+}
+
+// metricSample is a single labeled observation within a metric family.
+type metricSample struct {
+	tags  map[string]string
+	value string
+	ts    int64
+}
+
+// metricFamily groups every sample published under the same metric name, along with the
+// metadata ("# HELP"/"# TYPE"/"# UNIT") that OpenMetrics requires to precede them.
+type metricFamily struct {
+	name    string
+	mtype   metricType
+	unit    string
+	desc    string
+	samples []metricSample
+}
+
+// contentTypeFor returns the HTTP Content-Type to advertise for the body buildExposition
+// produces, which depends on whether OpenMetrics mode is enabled.
+func contentTypeFor(config map[string]ctypes.ConfigValue) string {
+	if isOpenMetrics(config) {
+		return "application/openmetrics-text; version=1.0.0"
+	}
+	return "text/plain; version=0.0.4"
+}
+
+func isOpenMetrics(config map[string]ctypes.ConfigValue) bool {
+	om, ok := config["openmetrics"]
+	if !ok {
+		return false
+	}
+	return om.(ctypes.ConfigValueBool).Value
+}
+
+// buildExposition renders metrics in Prometheus text format 0.0.4, or, when the
+// "openmetrics" config flag is set, in OpenMetrics text format 1.0.0 complete with
+// per-family HELP/TYPE/UNIT metadata and per-sample timestamps.
+func buildExposition(metrics []plugin.MetricType, config map[string]ctypes.ConfigValue) (string, error) {
+	openmetrics := isOpenMetrics(config)
+	typeMap, err := parseTypeMap(config)
+	if err != nil {
+		return "", err
+	}
+
+	var order []string
+	families := make(map[string]*metricFamily)
+
+	for _, m := range metrics {
+		name, tags, value, ts, keep := mangleMetric(m, config)
+		if !keep {
+			continue
+		}
+
+		fam, ok := families[name]
+		if !ok {
+			fam = &metricFamily{
+				name:  name,
+				mtype: metricTypeFor(name, m, typeMap),
+				unit:  tags["unit"],
+				desc:  m.Tags()[descriptionTag],
+			}
+			families[name] = fam
+			order = append(order, name)
+		}
+		fam.samples = append(fam.samples, metricSample{tags: tags, value: value, ts: ts})
+	}
+
+	buf := new(bytes.Buffer)
+	for _, name := range order {
+		fam := families[name]
+
+		desc := fam.desc
+		if desc == "" {
+			desc = fam.name
+		}
+		fmt.Fprintf(buf, "# HELP %s %s\n", fam.name, desc)
+		fmt.Fprintf(buf, "# TYPE %s %s\n", fam.name, fam.mtype)
+		if openmetrics && fam.unit != "" {
+			fmt.Fprintf(buf, "# UNIT %s %s\n", fam.name, fam.unit)
+		}
+
+		for _, s := range fam.samples {
+			buf.WriteString(prometheusString(fam.name, s.tags, s.value))
+			if openmetrics {
+				fmt.Fprintf(buf, " %s\n", formatOpenMetricsTimestamp(s.ts))
+			} else {
+				fmt.Fprintf(buf, " %d\n", s.ts)
+			}
+		}
+	}
+
+	if openmetrics {
+		buf.WriteString("# EOF\n")
+	}
+
+	return buf.String(), nil
+}
+
+// formatOpenMetricsTimestamp converts the millisecond timestamp mangleMetric computes
+// into the fractional-seconds realnumber OpenMetrics text format 1.0.0 requires
+// (e.g. "1520879607.789"), rather than the milliseconds the legacy 0.0.4 format uses.
+func formatOpenMetricsTimestamp(ms int64) string {
+	return strconv.FormatFloat(float64(ms)/1000, 'f', -1, 64)
+}
+
+// metricTypeFor infers a metric's OpenMetrics type, preferring an explicit
+// prometheus_type tag on the metric over the config-provided type_map, and falling back
+// to "untyped" when neither applies.
+func metricTypeFor(name string, m plugin.MetricType, typeMap []typeMapping) metricType {
+	if tagged, ok := m.Tags()[prometheusTypeTag]; ok {
+		switch metricType(tagged) {
+		case metricTypeCounter, metricTypeGauge, metricTypeUntyped:
+			return metricType(tagged)
+		}
+	}
+
+	for _, tm := range typeMap {
+		if tm.re.MatchString(name) {
+			return tm.mtype
+		}
+	}
+
+	return metricTypeUntyped
+}
+
+// parseTypeMap parses the "type_map" config value, a semicolon-separated list of
+// "regex=type" pairs, into an ordered list of compiled regexes. An empty or absent
+// type_map yields a nil slice.
+func parseTypeMap(config map[string]ctypes.ConfigValue) ([]typeMapping, error) {
+	raw, ok := config["type_map"]
+	if !ok {
+		return nil, nil
+	}
+	str, ok := raw.(ctypes.ConfigValueStr)
+	if !ok || strings.TrimSpace(str.Value) == "" {
+		return nil, nil
+	}
+
+	var mappings []typeMapping
+	for _, pair := range strings.Split(str.Value, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid type_map entry %q: expected regex=type", pair)
+		}
+
+		pattern, typ := strings.TrimSpace(parts[0]), metricType(strings.TrimSpace(parts[1]))
+		switch typ {
+		case metricTypeCounter, metricTypeGauge, metricTypeUntyped:
+		default:
+			return nil, fmt.Errorf("invalid type_map entry %q: unknown type %q", pair, typ)
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid type_map entry %q: %v", pair, err)
+		}
+
+		mappings = append(mappings, typeMapping{re: re, mtype: typ})
+	}
+
+	return mappings, nil
+}
@@ -0,0 +1,126 @@
+package prometheus
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core"
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+func newTestMetric(ns []string, tags map[string]string, unit string, data interface{}) plugin.MetricType {
+	return *plugin.NewMetricType(core.NewNamespace(ns...), time.Unix(1520879607, 789000000), tags, unit, data)
+}
+
+func TestParseTypeMap(t *testing.T) {
+	cases := []struct {
+		name    string
+		raw     string
+		wantErr bool
+		wantLen int
+	}{
+		{"empty", "", false, 0},
+		{"single", "^http_.*$=counter", false, 1},
+		{"multiple preserve order", "^a$=counter;^b$=gauge", false, 2},
+		{"missing equals", "no-equals-sign", true, 0},
+		{"unknown type", "^a$=bogus", true, 0},
+		{"invalid regex", "(=counter", true, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := map[string]ctypes.ConfigValue{
+				"type_map": ctypes.ConfigValueStr{Value: c.raw},
+			}
+			got, err := parseTypeMap(config)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != c.wantLen {
+				t.Fatalf("expected %d mappings, got %d", c.wantLen, len(got))
+			}
+		})
+	}
+}
+
+func TestMetricTypeForPrecedence(t *testing.T) {
+	typeMap, err := parseTypeMap(map[string]ctypes.ConfigValue{
+		"type_map": ctypes.ConfigValueStr{Value: "^http_.*$=counter"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	taggedGauge := newTestMetric(nil, map[string]string{"prometheus_type": "gauge"}, "", 1)
+	if got := metricTypeFor("http_requests_total", taggedGauge, typeMap); got != metricTypeGauge {
+		t.Errorf("explicit prometheus_type tag should win over type_map, got %v", got)
+	}
+
+	untagged := newTestMetric(nil, map[string]string{}, "", 1)
+	if got := metricTypeFor("http_requests_total", untagged, typeMap); got != metricTypeCounter {
+		t.Errorf("expected type_map match, got %v", got)
+	}
+
+	unmatched := newTestMetric(nil, map[string]string{}, "", 1)
+	if got := metricTypeFor("other_metric", unmatched, typeMap); got != metricTypeUntyped {
+		t.Errorf("expected untyped default, got %v", got)
+	}
+}
+
+func TestFormatOpenMetricsTimestamp(t *testing.T) {
+	if got := formatOpenMetricsTimestamp(1520879607789); got != "1520879607.789" {
+		t.Errorf("expected 1520879607.789, got %s", got)
+	}
+}
+
+func TestBuildExpositionOpenMetricsFraming(t *testing.T) {
+	config := map[string]ctypes.ConfigValue{
+		"openmetrics": ctypes.ConfigValueBool{Value: true},
+	}
+	metrics := []plugin.MetricType{
+		newTestMetric([]string{"intel", "mock", "foo"}, map[string]string{"prometheus_type": "counter"}, "", int64(42)),
+	}
+
+	out, err := buildExposition(metrics, config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(out, "# HELP intel_mock_foo") {
+		t.Errorf("missing HELP line: %s", out)
+	}
+	if !strings.Contains(out, "# TYPE intel_mock_foo counter") {
+		t.Errorf("missing TYPE line: %s", out)
+	}
+	if !strings.Contains(out, " 1520879607.789\n") {
+		t.Errorf("expected fractional-seconds timestamp, got: %s", out)
+	}
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Errorf("missing EOF terminator: %s", out)
+	}
+}
+
+func TestBuildExpositionLegacyTimestampIsMilliseconds(t *testing.T) {
+	config := map[string]ctypes.ConfigValue{
+		"openmetrics": ctypes.ConfigValueBool{Value: false},
+	}
+	metrics := []plugin.MetricType{
+		newTestMetric([]string{"intel", "mock", "foo"}, map[string]string{}, "", int64(42)),
+	}
+
+	out, err := buildExposition(metrics, config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(out, " 1520879607789\n") {
+		t.Errorf("expected millisecond timestamp on the legacy path, got: %s", out)
+	}
+}
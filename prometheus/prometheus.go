@@ -13,7 +13,6 @@ import (
 	"sync"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/cenkalti/backoff"
 
 	"github.com/intelsdi-x/snap/control/plugin"
@@ -43,9 +42,11 @@ var (
 )
 
 type clientConnection struct {
-	Key      string
-	Conn     *http.Client
-	LastUsed time.Time
+	Key       string
+	Conn      *http.Client
+	Transport *http.Transport
+	Auth      *authConfig
+	LastUsed  time.Time
 }
 
 func watchConnections() {
@@ -82,21 +83,21 @@ func (p *prometheusPublisher) GetConfigPolicy() (*cpolicy.ConfigPolicy, error) {
 	cp := cpolicy.New()
 	config := cpolicy.NewPolicyNode()
 
-	r1, err := cpolicy.NewStringRule("host", true)
+	r1, err := cpolicy.NewStringRule("host", false, "")
 	if err != nil {
 		panic(err)
 	}
-	r1.Description = "Prometheus push gateway host"
+	r1.Description = "Prometheus push gateway host (required when mode is \"pushgateway\")"
 	config.Add(r1)
 
-	r2, err := cpolicy.NewIntegerRule("port", true)
+	r2, err := cpolicy.NewIntegerRule("port", false, 0)
 	if err != nil {
 		panic(err)
 	}
-	r2.Description = "Prometheus push gateway port"
+	r2.Description = "Prometheus push gateway port (required when mode is \"pushgateway\")"
 	config.Add(r2)
 
-	r3, err := cpolicy.NewBoolRule("https", true)
+	r3, err := cpolicy.NewBoolRule("https", false, false)
 	if err != nil {
 		panic(err)
 	}
@@ -145,37 +146,183 @@ func (p *prometheusPublisher) GetConfigPolicy() (*cpolicy.ConfigPolicy, error) {
 	r9.Description = "Replace metrics within Pushgateway upon push"
 	config.Add(r9)
 
+	r10, err := cpolicy.NewBoolRule("openmetrics", false, false)
+	if err != nil {
+		panic(err)
+	}
+	r10.Description = "Emit OpenMetrics text format 1.0.0 (HELP/TYPE/UNIT and sample timestamps) instead of the legacy Prometheus text format"
+	config.Add(r10)
+
+	r11, err := cpolicy.NewStringRule("type_map", false, "")
+	if err != nil {
+		panic(err)
+	}
+	r11.Description = "Semicolon-separated list of regex=type pairs (e.g. \"^http_requests_total$=counter\") used to infer a metric's TYPE when its prometheus_type tag is absent; unmatched metrics default to untyped"
+	config.Add(r11)
+
+	r12, err := cpolicy.NewStringRule("mode", false, modePushgateway)
+	if err != nil {
+		panic(err)
+	}
+	r12.Description = "Publish transport: \"pushgateway\" (default) pushes text-format metrics to a Pushgateway, \"remote_write\" POSTs a snappy-compressed Remote Write 1.0 WriteRequest to 'url'"
+	config.Add(r12)
+
+	r13, err := cpolicy.NewStringRule("url", false, "")
+	if err != nil {
+		panic(err)
+	}
+	r13.Description = "Destination URL for mode \"remote_write\" (e.g. a Cortex/Mimir/Thanos/VictoriaMetrics remote-write endpoint)"
+	config.Add(r13)
+
+	r14, err := cpolicy.NewStringRule("serve_mode", false, serveModePush)
+	if err != nil {
+		panic(err)
+	}
+	r14.Description = "Delivery: \"push\" (default) sends metrics via 'mode' on every Publish, \"pull\" caches them for scraping from 'listen_addr', \"both\" does both"
+	config.Add(r14)
+
+	r15, err := cpolicy.NewStringRule("listen_addr", false, defaultListenAddr)
+	if err != nil {
+		panic(err)
+	}
+	r15.Description = "Address the pull-mode /metrics HTTP endpoint listens on, for serve_mode \"pull\" or \"both\""
+	config.Add(r15)
+
+	r16, err := cpolicy.NewIntegerRule("sample_ttl_secs", false, defaultSampleTTLSecs)
+	if err != nil {
+		panic(err)
+	}
+	r16.Description = "Seconds a cached sample is served before being evicted as stale, for serve_mode \"pull\" or \"both\""
+	config.Add(r16)
+
+	r17, err := cpolicy.NewStringRule("relabel_config", false, "")
+	if err != nil {
+		panic(err)
+	}
+	r17.Description = "Path to a YAML file of Prometheus-style metric_relabel_configs, hot-reloaded on change"
+	config.Add(r17)
+
+	r18, err := cpolicy.NewStringRule("basic_auth_user", false, "")
+	if err != nil {
+		panic(err)
+	}
+	r18.Description = "Username for HTTP basic auth against the Prometheus endpoint"
+	config.Add(r18)
+
+	r19, err := cpolicy.NewStringRule("basic_auth_password", false, "")
+	if err != nil {
+		panic(err)
+	}
+	r19.Description = "Password for HTTP basic auth; prefer basic_auth_password_file to avoid storing secrets in task manifests"
+	config.Add(r19)
+
+	r20, err := cpolicy.NewStringRule("basic_auth_password_file", false, "")
+	if err != nil {
+		panic(err)
+	}
+	r20.Description = "Path to a file containing the HTTP basic auth password"
+	config.Add(r20)
+
+	r21, err := cpolicy.NewStringRule("bearer_token", false, "")
+	if err != nil {
+		panic(err)
+	}
+	r21.Description = "Bearer token sent as an Authorization header; prefer bearer_token_file to avoid storing secrets in task manifests"
+	config.Add(r21)
+
+	r22, err := cpolicy.NewStringRule("bearer_token_file", false, "")
+	if err != nil {
+		panic(err)
+	}
+	r22.Description = "Path to a file containing the bearer token"
+	config.Add(r22)
+
+	r23, err := cpolicy.NewStringRule("tls_ca_file", false, "")
+	if err != nil {
+		panic(err)
+	}
+	r23.Description = "Path to a PEM CA bundle used to verify the Prometheus endpoint's certificate"
+	config.Add(r23)
+
+	r24, err := cpolicy.NewStringRule("tls_cert_file", false, "")
+	if err != nil {
+		panic(err)
+	}
+	r24.Description = "Path to a PEM client certificate for mutual TLS"
+	config.Add(r24)
+
+	r25, err := cpolicy.NewStringRule("tls_key_file", false, "")
+	if err != nil {
+		panic(err)
+	}
+	r25.Description = "Path to the PEM private key matching tls_cert_file"
+	config.Add(r25)
+
+	r26, err := cpolicy.NewStringRule("tls_server_name", false, "")
+	if err != nil {
+		panic(err)
+	}
+	r26.Description = "Server name used for TLS certificate verification, overriding the name derived from the URL"
+	config.Add(r26)
+
+	r27, err := cpolicy.NewBoolRule("tls_insecure_skip_verify", false, false)
+	if err != nil {
+		panic(err)
+	}
+	r27.Description = "Skip TLS certificate verification; for lab setups only"
+	config.Add(r27)
+
+	r28, err := cpolicy.NewStringRule("log_format", false, "text")
+	if err != nil {
+		panic(err)
+	}
+	r28.Description = "Log handler: \"text\" (default) or \"json\""
+	config.Add(r28)
+
 	cp.Add([]string{""}, config)
 	return cp, nil
 }
 
 // Publish publishes metric data to Prometheus.
 func (p *prometheusPublisher) Publish(contentType string, content []byte, config map[string]ctypes.ConfigValue) error {
-	logger := log.New()
+	logger := getLogger(config)
 	var metrics []plugin.MetricType
 
 	switch contentType {
 	case plugin.SnapGOBContentType:
 		dec := gob.NewDecoder(bytes.NewBuffer(content))
 		if err := dec.Decode(&metrics); err != nil {
-			logger.Printf("Error decoding GOB: error=%v content=%v", err, content)
+			logger.Error("error decoding GOB", "error", err)
 			return err
 		}
 	case plugin.SnapJSONContentType:
 		err := json.Unmarshal(content, &metrics)
 		if err != nil {
-			logger.Printf("Error decoding JSON: error=%v content=%v", err, content)
+			logger.Error("error decoding JSON", "error", err)
 			return err
 		}
 	default:
-		logger.Printf("Error unknown content type '%v'", contentType)
+		logger.Error("unknown content type", "content_type", contentType)
 		return fmt.Errorf("Unknown content type '%s'", contentType)
 	}
 
+	ensureRelabelWatcher(config)
+
+	if servesPull(config) {
+		updatePullRegistry(metrics, config)
+		startPullServer(config)
+	}
+
+	if !servesPush(config) {
+		return nil
+	}
+
 	promUrl, err := prometheusUrl(config)
 	if err != nil {
-		panic(err)
+		logger.Error("error determining Prometheus URL", "error", err)
+		return err
 	}
+	logger = logger.With("url", promUrl.String())
 
 	b := backoff.NewExponentialBackOff()
 	retries := config["retries"].(ctypes.ConfigValueInt).Value
@@ -184,11 +331,10 @@ func (p *prometheusPublisher) Publish(contentType string, content []byte, config
 
 		client, err := selectClient(config, forceRefresh)
 		if err != nil {
-			logger.Printf("Could not select a Prometheus client (retry %d of %d): %v",
-				retry, retries, err)
+			logger.Warn("could not select a Prometheus client", "retry", retry, "retries", retries, "error", err)
 			if retry+1 < retries {
 				backoffDuration := b.NextBackOff()
-				logger.Printf("Backing off next Prometheus request by: %v", backoffDuration)
+				logger.Debug("backing off next Prometheus request", "duration", backoffDuration)
 				time.Sleep(backoffDuration)
 			}
 			continue
@@ -196,11 +342,10 @@ func (p *prometheusPublisher) Publish(contentType string, content []byte, config
 
 		err = sendMetrics(config, promUrl, client, metrics)
 		if err != nil {
-			logger.Printf("Could not send metrics to Prometheus (retry %d of %d): %v",
-				retry, retries, err)
+			logger.Warn("could not send metrics to Prometheus", "retry", retry, "retries", retries, "error", err)
 			if retry+1 < retries {
 				backoffDuration := b.NextBackOff()
-				logger.Printf("Backing off next Prometheus request by: %v", backoffDuration)
+				logger.Debug("backing off next Prometheus request", "duration", backoffDuration)
 				time.Sleep(backoffDuration)
 			}
 			continue
@@ -214,12 +359,15 @@ func (p *prometheusPublisher) Publish(contentType string, content []byte, config
 
 func sendMetrics(config map[string]ctypes.ConfigValue,
 	promUrl *url.URL, client *clientConnection, metrics []plugin.MetricType) error {
-	logger := getLogger(config)
-	buf := new(bytes.Buffer)
-	for _, m := range metrics {
-		name, tags, value, _ := mangleMetric(m, config)
-		buf.WriteString(prometheusString(name, tags, value))
-		buf.WriteByte('\n')
+	if publishMode(config) == modeRemoteWrite {
+		return sendRemoteWriteMetrics(config, promUrl, client, metrics)
+	}
+
+	logger := getLogger(config).With("url", promUrl.String())
+	body, err := buildExposition(metrics, config)
+	if err != nil {
+		logger.Error("error building Prometheus exposition", "error", err)
+		return err
 	}
 
 	// A PUT will update the value of a metric for a job, a POST will replace those metrics
@@ -230,17 +378,18 @@ func sendMetrics(config map[string]ctypes.ConfigValue,
 		httpMethod = "POST"
 	}
 
-	req, err := http.NewRequest(httpMethod, promUrl.String(), bytes.NewReader(buf.Bytes()))
-	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	req, err := http.NewRequest(httpMethod, promUrl.String(), bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", contentTypeFor(config))
+	client.Auth.applyAuth(req)
 	res, err := client.Conn.Do(req)
 	if err != nil {
-		logger.Error("Error sending data to Prometheus: %v", err)
+		logger.Error("error sending data to Prometheus", "error", err)
 		return err
 	}
 	defer res.Body.Close()
 	_, err = ioutil.ReadAll(res.Body)
 	if err != nil {
-		logger.Error("Error getting Prometheus response: %v", err)
+		logger.Error("error getting Prometheus response", "error", err)
 		return err
 	}
 	return nil
@@ -260,7 +409,7 @@ func prometheusString(name string, tags map[string]string, value string) string
 
 func mangleMetric(m plugin.MetricType,
 	config map[string]ctypes.ConfigValue) (name string,
-	tags map[string]string, value string, ts int64) {
+	tags map[string]string, value string, ts int64, keep bool) {
 	tags = make(map[string]string)
 	ns := m.Namespace().Strings()
 	isDynamic, indexes := m.Namespace().IsDynamic()
@@ -299,17 +448,40 @@ func mangleMetric(m plugin.MetricType,
 				tags["host"] = v
 			}
 		} else {
-			tags[invalidLabel.ReplaceAllString(k, "_")] = v
+			tags[k] = v
 		}
 	}
 
+	// Apply any configured metric_relabel_configs before sanitizing label names, so
+	// rules can reference the original (Prometheus-style) source labels.
+	tags, keep = applyRelabeling(tags, config)
+
+	sanitized := make(map[string]string, len(tags))
+	for k, v := range tags {
+		sanitized[invalidLabel.ReplaceAllString(k, "_")] = v
+	}
+	tags = sanitized
+
 	name = strings.Join(ns, "_")
 	value = fmt.Sprint(m.Data())
-	ts = m.Timestamp().Unix() * 1000
+	ts = m.Timestamp().UnixNano() / int64(time.Millisecond)
 	return
 }
 
 func prometheusUrl(config map[string]ctypes.ConfigValue) (*url.URL, error) {
+	if publishMode(config) == modeRemoteWrite {
+		raw, ok := config["url"].(ctypes.ConfigValueStr)
+		if !ok || raw.Value == "" {
+			return nil, fmt.Errorf("mode \"remote_write\" requires a non-empty 'url' config value")
+		}
+		return url.Parse(raw.Value)
+	}
+
+	host, ok := config["host"].(ctypes.ConfigValueStr)
+	if !ok || host.Value == "" {
+		return nil, fmt.Errorf("mode \"pushgateway\" requires a non-empty 'host' config value")
+	}
+
 	var prefix = "http"
 	if config["https"].(ctypes.ConfigValueBool).Value {
 		prefix = "https"
@@ -346,97 +518,53 @@ func prometheusUrl(config map[string]ctypes.ConfigValue) (*url.URL, error) {
 func selectClient(
 	config map[string]ctypes.ConfigValue, forceRefresh bool) (*clientConnection, error) {
 	// This is not an ideal way to get the logger but deferring solving this for a later date
-	logger := getLogger(config)
-
 	// Pool changes need to be safe (read & write) since the plugin can be called concurrently by snapteld.
 	m.Lock()
 	defer m.Unlock()
 
 	promUrl, err := prometheusUrl(config)
-	key := fmt.Sprintf("%s", promUrl.String())
-
-	// Do we have a existing client?
-	if clientPool[key] == nil || forceRefresh {
-		// create one and add to the pool
-		timeoutSecs := int64(config["timeout_secs"].(ctypes.ConfigValueInt).Value)
-		con := &http.Client{
-			Timeout: time.Second * time.Duration(timeoutSecs),
-		}
+	if err != nil {
+		return nil, err
+	}
+	logger := getLogger(config).With("url", promUrl.String())
 
-		if err != nil {
-			return nil, err
-		}
+	auth, err := loadAuthConfig(config)
+	if err != nil {
+		return nil, err
+	}
 
-		cCon := &clientConnection{
-			Key:      key,
-			Conn:     con,
-			LastUsed: time.Now(),
-		}
-		// Add to the pool
-		clientPool[key] = cCon
+	// Auth/TLS material is part of the pool key so that two profiles pushing to the
+	// same URL don't collide on each other's transport.
+	key := fmt.Sprintf("%s|%s", promUrl.String(), auth.authKey())
 
-		logger.Debug("Opening new Prometheus connection[", promUrl.String(), "]")
-		return clientPool[key], nil
+	existing := clientPool[key]
+	if existing != nil && !forceRefresh && !auth.certFilesChanged(existing.LastUsed) {
+		existing.LastUsed = time.Now()
+		logger.Debug("using open Prometheus connection")
+		return existing, nil
 	}
-	// Update when it was accessed
-	clientPool[key].LastUsed = time.Now()
-	// Return it
-	logger.Debug("Using open Prometheus connection[", promUrl.String(), "]")
-	return clientPool[key], nil
-}
 
-func getLogger(config map[string]ctypes.ConfigValue) *log.Entry {
-	logger := log.WithFields(log.Fields{
-		"plugin-name":    name,
-		"plugin-version": version,
-		"plugin-type":    pluginType.String(),
-	})
-
-	// default
-	log.SetLevel(log.WarnLevel)
-
-	if debug, ok := config["debug"]; ok {
-		switch v := debug.(type) {
-		case ctypes.ConfigValueBool:
-			if v.Value {
-				log.SetLevel(log.DebugLevel)
-				return logger
-			}
-		default:
-			logger.WithFields(log.Fields{
-				"field":         "debug",
-				"type":          v,
-				"expected type": "ctypes.ConfigValueBool",
-			}).Error("invalid config type")
-		}
+	transport, err := auth.buildTransport()
+	if err != nil {
+		return nil, err
 	}
 
-	if loglevel, ok := config["log-level"]; ok {
-		switch v := loglevel.(type) {
-		case ctypes.ConfigValueStr:
-			switch strings.ToLower(v.Value) {
-			case "warn":
-				log.SetLevel(log.WarnLevel)
-			case "error":
-				log.SetLevel(log.ErrorLevel)
-			case "debug":
-				log.SetLevel(log.DebugLevel)
-			case "info":
-				log.SetLevel(log.InfoLevel)
-			default:
-				log.WithFields(log.Fields{
-					"value":             strings.ToLower(v.Value),
-					"acceptable values": "warn, error, debug, info",
-				}).Warn("invalid config value")
-			}
-		default:
-			logger.WithFields(log.Fields{
-				"field":         "log-level",
-				"type":          v,
-				"expected type": "ctypes.ConfigValueStr",
-			}).Error("invalid config type")
-		}
+	timeoutSecs := int64(config["timeout_secs"].(ctypes.ConfigValueInt).Value)
+	con := &http.Client{
+		Transport: transport,
+		Timeout:   time.Second * time.Duration(timeoutSecs),
+	}
+
+	cCon := &clientConnection{
+		Key:       key,
+		Conn:      con,
+		Transport: transport,
+		Auth:      auth,
+		LastUsed:  time.Now(),
 	}
+	// Add to the pool
+	clientPool[key] = cCon
 
-	return logger
+	logger.Debug("opening new Prometheus connection")
+	return cCon, nil
 }
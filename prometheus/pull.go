@@ -0,0 +1,223 @@
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+const (
+	serveModePush = "push"
+	serveModePull = "pull"
+	serveModeBoth = "both"
+
+	defaultListenAddr    = ":9100"
+	defaultSampleTTLSecs = 120
+)
+
+var (
+	// pullRegistry caches the most recent sample per (metric name, labelset), serving
+	// the same role for pull mode that a Pushgateway plays for push mode.
+	pullRegistry = make(map[string]*pulledFamily)
+	// pullServerStarted guards the lazy, once-per-process startup of the /metrics
+	// listener, the same way watchConnections is started once from init().
+	pullServerStarted bool
+)
+
+// pulledSample is one cached, TTL-bounded observation within a pulled metric family.
+type pulledSample struct {
+	tags    map[string]string
+	value   string
+	ts      int64
+	expires time.Time
+}
+
+// pulledFamily mirrors metricFamily but holds samples keyed by their labelset so a
+// later sample for the same labels overwrites the earlier one instead of accumulating.
+type pulledFamily struct {
+	mtype   metricType
+	unit    string
+	desc    string
+	samples map[string]*pulledSample
+}
+
+func serveMode(config map[string]ctypes.ConfigValue) string {
+	v, ok := config["serve_mode"]
+	if !ok {
+		return serveModePush
+	}
+	str, ok := v.(ctypes.ConfigValueStr)
+	if !ok || str.Value == "" {
+		return serveModePush
+	}
+	return str.Value
+}
+
+func servesPush(config map[string]ctypes.ConfigValue) bool {
+	switch serveMode(config) {
+	case serveModePull:
+		return false
+	default:
+		return true
+	}
+}
+
+func servesPull(config map[string]ctypes.ConfigValue) bool {
+	switch serveMode(config) {
+	case serveModePull, serveModeBoth:
+		return true
+	default:
+		return false
+	}
+}
+
+func sampleTTL(config map[string]ctypes.ConfigValue) time.Duration {
+	v, ok := config["sample_ttl_secs"]
+	if !ok {
+		return defaultSampleTTLSecs * time.Second
+	}
+	i, ok := v.(ctypes.ConfigValueInt)
+	if !ok || i.Value <= 0 {
+		return defaultSampleTTLSecs * time.Second
+	}
+	return time.Duration(i.Value) * time.Second
+}
+
+func listenAddr(config map[string]ctypes.ConfigValue) string {
+	v, ok := config["listen_addr"]
+	if !ok {
+		return defaultListenAddr
+	}
+	str, ok := v.(ctypes.ConfigValueStr)
+	if !ok || str.Value == "" {
+		return defaultListenAddr
+	}
+	return str.Value
+}
+
+// labelKey deterministically serializes a labelset so identical labels for the same
+// metric name always resolve to the same registry entry.
+func labelKey(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%s,", k, tags[k])
+	}
+	return b.String()
+}
+
+// updatePullRegistry caches the latest value of every sample in metrics, keyed by
+// (name, labelset), for the pull-mode /metrics endpoint to serve.
+func updatePullRegistry(metrics []plugin.MetricType, config map[string]ctypes.ConfigValue) {
+	ttl := sampleTTL(config)
+	typeMap, err := parseTypeMap(config)
+	if err != nil {
+		// Registry updates must not block publishing; an invalid type_map is ignored
+		// here, not logged. Only the Pushgateway push path reports it.
+		typeMap = nil
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	for _, metric := range metrics {
+		name, tags, value, ts, keep := mangleMetric(metric, config)
+		if !keep {
+			continue
+		}
+
+		fam, ok := pullRegistry[name]
+		if !ok {
+			fam = &pulledFamily{
+				samples: make(map[string]*pulledSample),
+			}
+			pullRegistry[name] = fam
+		}
+		fam.mtype = metricTypeFor(name, metric, typeMap)
+		fam.unit = tags["unit"]
+		fam.desc = metric.Tags()[descriptionTag]
+
+		fam.samples[labelKey(tags)] = &pulledSample{
+			tags:    tags,
+			value:   value,
+			ts:      ts,
+			expires: time.Now().Add(ttl),
+		}
+	}
+}
+
+// startPullServer lazily starts the /metrics HTTP listener once per process, on the
+// first Publish that serves pull mode.
+func startPullServer(config map[string]ctypes.ConfigValue) {
+	m.Lock()
+	defer m.Unlock()
+
+	if pullServerStarted {
+		return
+	}
+	pullServerStarted = true
+
+	addr := listenAddr(config)
+	logger := getLogger(config).With("listen_addr", addr)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", servePullMetrics)
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Error("Prometheus pull-mode listener exited", "error", err)
+		}
+	}()
+}
+
+// servePullMetrics renders the current registry contents in Prometheus text format,
+// with per-family HELP/TYPE lines as buildExposition emits for the push path plus a
+// UNIT line whenever the family has a unit, evicting any sample whose TTL has elapsed
+// first. Samples carry no timestamp.
+func servePullMetrics(w http.ResponseWriter, r *http.Request) {
+	buf := new(bytes.Buffer)
+	now := time.Now()
+
+	m.Lock()
+	for name, fam := range pullRegistry {
+		for key, s := range fam.samples {
+			if now.After(s.expires) {
+				delete(fam.samples, key)
+			}
+		}
+		if len(fam.samples) == 0 {
+			delete(pullRegistry, name)
+			continue
+		}
+
+		desc := fam.desc
+		if desc == "" {
+			desc = name
+		}
+		fmt.Fprintf(buf, "# HELP %s %s\n", name, desc)
+		fmt.Fprintf(buf, "# TYPE %s %s\n", name, fam.mtype)
+		if fam.unit != "" {
+			fmt.Fprintf(buf, "# UNIT %s %s\n", name, fam.unit)
+		}
+
+		for _, s := range fam.samples {
+			buf.WriteString(prometheusString(name, s.tags, s.value))
+			buf.WriteByte('\n')
+		}
+	}
+	m.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,248 @@
+package prometheus
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+// relabelAction mirrors the action verbs Prometheus accepts in metric_relabel_configs.
+type relabelAction string
+
+const (
+	relabelReplace   relabelAction = "replace"
+	relabelKeep      relabelAction = "keep"
+	relabelDrop      relabelAction = "drop"
+	relabelLabelDrop relabelAction = "labeldrop"
+	relabelLabelKeep relabelAction = "labelkeep"
+	relabelHashMod   relabelAction = "hashmod"
+)
+
+// relabelRule is one entry of a Prometheus-schema metric_relabel_configs list.
+type relabelRule struct {
+	SourceLabels []string      `yaml:"source_labels"`
+	Separator    string        `yaml:"separator"`
+	Regex        string        `yaml:"regex"`
+	TargetLabel  string        `yaml:"target_label"`
+	Replacement  string        `yaml:"replacement"`
+	Action       relabelAction `yaml:"action"`
+	Modulus      uint64        `yaml:"modulus"`
+
+	compiled *regexp.Regexp
+}
+
+// relabelFile is the top-level shape of a relabel_config YAML file.
+type relabelFile struct {
+	MetricRelabelConfigs []relabelRule `yaml:"metric_relabel_configs"`
+}
+
+var (
+	// rulesMu guards relabelRulesByPath, the same way m guards clientPool: the active
+	// ruleset is held at package level alongside it, keyed by relabel_config path so
+	// two tasks in the same plugin process configuring different files each get their
+	// own ruleset instead of one task's reload silently overwriting another's.
+	rulesMu            sync.RWMutex
+	relabelRulesByPath = make(map[string][]relabelRule)
+
+	// watcherMu guards watchersStarted. It is held across the full check-and-start
+	// sequence in ensureRelabelWatcher, rather than just the read of the flag, so two
+	// concurrent first-time Publish calls for the same path can't both observe "not
+	// running" and both spin up a watcher for it.
+	watcherMu       sync.Mutex
+	watchersStarted = make(map[string]bool)
+)
+
+func relabelConfigPath(config map[string]ctypes.ConfigValue) string {
+	v, ok := config["relabel_config"]
+	if !ok {
+		return ""
+	}
+	str, ok := v.(ctypes.ConfigValueStr)
+	if !ok {
+		return ""
+	}
+	return str.Value
+}
+
+// ensureRelabelWatcher loads the configured relabel_config file on first use and
+// starts an fsnotify watcher that reloads it on every change, for as long as the
+// process runs. It is a no-op once a watcher is already running for the same path.
+//
+// Publish can be called concurrently by snapteld, so the whole check-and-start
+// sequence runs under watcherMu rather than just the initial read: otherwise two
+// concurrent first-time calls could both see "not running" and each start their own
+// watcher and goroutine for the same path.
+func ensureRelabelWatcher(config map[string]ctypes.ConfigValue) {
+	path := relabelConfigPath(config)
+	if path == "" {
+		return
+	}
+
+	watcherMu.Lock()
+	defer watcherMu.Unlock()
+
+	if watchersStarted[path] {
+		return
+	}
+
+	logger := getLogger(config).With("relabel_config", path)
+	reloadRelabelConfig(path, logger)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Error("error creating relabel_config watcher", "error", err)
+		return
+	}
+	if err := watcher.Add(path); err != nil {
+		logger.Error("error watching relabel_config", "error", err)
+		return
+	}
+
+	watchersStarted[path] = true
+
+	go watchRelabelConfig(watcher, path, logger)
+}
+
+func watchRelabelConfig(watcher *fsnotify.Watcher, path string, logger *slog.Logger) {
+	for event := range watcher.Events {
+		switch {
+		case event.Op&fsnotify.Write == fsnotify.Write:
+			reloadRelabelConfig(path, logger)
+		case event.Op&fsnotify.Rename == fsnotify.Rename:
+			// vim-style saves emit RENAME+MODIFY+DELETE against the watched inode;
+			// re-add the watch against the path's new inode so later writes still fire.
+			watcher.Remove(path)
+			if err := watcher.Add(path); err != nil {
+				logger.Error("error re-adding relabel_config watch after rename", "error", err)
+				continue
+			}
+			reloadRelabelConfig(path, logger)
+		}
+	}
+}
+
+// reloadRelabelConfig parses path and swaps it in as the active ruleset for that path.
+// A parse failure is logged and the previous ruleset for path is kept rather than
+// disabling relabeling.
+func reloadRelabelConfig(path string, logger *slog.Logger) {
+	rules, err := loadRelabelConfig(path)
+	if err != nil {
+		logger.Error("error loading relabel_config, keeping previous rules", "error", err)
+		return
+	}
+
+	rulesMu.Lock()
+	relabelRulesByPath[path] = rules
+	rulesMu.Unlock()
+}
+
+func loadRelabelConfig(path string) ([]relabelRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file relabelFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	for i := range file.MetricRelabelConfigs {
+		rule := &file.MetricRelabelConfigs[i]
+		if rule.Separator == "" {
+			rule.Separator = ";"
+		}
+		if rule.Action == "" {
+			rule.Action = relabelReplace
+		}
+
+		pattern := rule.Regex
+		if pattern == "" {
+			pattern = "(.*)"
+		}
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %v", rule.Regex, err)
+		}
+		rule.compiled = re
+	}
+
+	return file.MetricRelabelConfigs, nil
+}
+
+// applyRelabeling runs config's relabel_config ruleset over tags, returning the
+// (possibly rewritten) labelset and false if any rule decided the metric should be
+// dropped entirely. A config with no relabel_config set gets an empty ruleset.
+func applyRelabeling(tags map[string]string, config map[string]ctypes.ConfigValue) (map[string]string, bool) {
+	path := relabelConfigPath(config)
+
+	rulesMu.RLock()
+	rules := relabelRulesByPath[path]
+	rulesMu.RUnlock()
+
+	for _, rule := range rules {
+		var keep bool
+		tags, keep = applyRelabelRule(tags, rule)
+		if !keep {
+			return tags, false
+		}
+	}
+	return tags, true
+}
+
+func applyRelabelRule(tags map[string]string, rule relabelRule) (map[string]string, bool) {
+	switch rule.Action {
+	case relabelLabelDrop:
+		for k := range tags {
+			if rule.compiled.MatchString(k) {
+				delete(tags, k)
+			}
+		}
+		return tags, true
+	case relabelLabelKeep:
+		for k := range tags {
+			if !rule.compiled.MatchString(k) {
+				delete(tags, k)
+			}
+		}
+		return tags, true
+	}
+
+	values := make([]string, len(rule.SourceLabels))
+	for i, label := range rule.SourceLabels {
+		values[i] = tags[label]
+	}
+	source := strings.Join(values, rule.Separator)
+	match := rule.compiled.FindStringSubmatchIndex(source)
+
+	switch rule.Action {
+	case relabelKeep:
+		return tags, match != nil
+	case relabelDrop:
+		return tags, match == nil
+	case relabelHashMod:
+		if rule.Modulus == 0 {
+			return tags, true
+		}
+		h := fnv.New64a()
+		h.Write([]byte(source))
+		tags[rule.TargetLabel] = strconv.FormatUint(h.Sum64()%rule.Modulus, 10)
+		return tags, true
+	default: // relabelReplace
+		if match == nil || rule.TargetLabel == "" {
+			return tags, true
+		}
+		tags[rule.TargetLabel] = string(rule.compiled.ExpandString(nil, rule.Replacement, source, match))
+		return tags, true
+	}
+}
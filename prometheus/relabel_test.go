@@ -0,0 +1,193 @@
+package prometheus
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+// compileRule fills in rule.compiled the way loadRelabelConfig does, anchoring the
+// regex the same way, so tests exercise the same matching behavior as production.
+func compileRule(rule relabelRule) relabelRule {
+	pattern := rule.Regex
+	if pattern == "" {
+		pattern = "(.*)"
+	}
+	rule.compiled = regexp.MustCompile("^(?:" + pattern + ")$")
+	if rule.Separator == "" {
+		rule.Separator = ";"
+	}
+	return rule
+}
+
+func TestApplyRelabelRuleReplace(t *testing.T) {
+	rule := compileRule(relabelRule{
+		SourceLabels: []string{"host"},
+		Regex:        "(.+)\\.example\\.com",
+		TargetLabel:  "short_host",
+		Replacement:  "$1",
+		Action:       relabelReplace,
+	})
+
+	tags, keep := applyRelabelRule(map[string]string{"host": "web1.example.com"}, rule)
+	if !keep {
+		t.Fatalf("replace should never drop a metric")
+	}
+	if tags["short_host"] != "web1" {
+		t.Errorf("expected short_host=web1, got %q", tags["short_host"])
+	}
+}
+
+func TestApplyRelabelRuleReplaceNoMatchLeavesTagsUntouched(t *testing.T) {
+	rule := compileRule(relabelRule{
+		SourceLabels: []string{"host"},
+		Regex:        "never-matches",
+		TargetLabel:  "short_host",
+		Replacement:  "$1",
+		Action:       relabelReplace,
+	})
+
+	tags, keep := applyRelabelRule(map[string]string{"host": "web1.example.com"}, rule)
+	if !keep {
+		t.Fatalf("replace should never drop a metric")
+	}
+	if _, ok := tags["short_host"]; ok {
+		t.Errorf("expected short_host to be left unset, got %q", tags["short_host"])
+	}
+}
+
+func TestApplyRelabelRuleKeep(t *testing.T) {
+	rule := compileRule(relabelRule{
+		SourceLabels: []string{"env"},
+		Regex:        "prod",
+		Action:       relabelKeep,
+	})
+
+	if _, keep := applyRelabelRule(map[string]string{"env": "prod"}, rule); !keep {
+		t.Errorf("expected matching labelset to be kept")
+	}
+	if _, keep := applyRelabelRule(map[string]string{"env": "staging"}, rule); keep {
+		t.Errorf("expected non-matching labelset to be dropped")
+	}
+}
+
+func TestApplyRelabelRuleDrop(t *testing.T) {
+	rule := compileRule(relabelRule{
+		SourceLabels: []string{"env"},
+		Regex:        "staging",
+		Action:       relabelDrop,
+	})
+
+	if _, keep := applyRelabelRule(map[string]string{"env": "staging"}, rule); keep {
+		t.Errorf("expected matching labelset to be dropped")
+	}
+	if _, keep := applyRelabelRule(map[string]string{"env": "prod"}, rule); !keep {
+		t.Errorf("expected non-matching labelset to be kept")
+	}
+}
+
+func TestApplyRelabelRuleLabelDrop(t *testing.T) {
+	rule := compileRule(relabelRule{
+		Regex:  "^tmp_.*$",
+		Action: relabelLabelDrop,
+	})
+
+	tags, keep := applyRelabelRule(map[string]string{"tmp_foo": "1", "keep_me": "2"}, rule)
+	if !keep {
+		t.Fatalf("labeldrop should never drop the metric itself")
+	}
+	if _, ok := tags["tmp_foo"]; ok {
+		t.Errorf("expected tmp_foo to be removed")
+	}
+	if _, ok := tags["keep_me"]; !ok {
+		t.Errorf("expected keep_me to survive")
+	}
+}
+
+func TestApplyRelabelRuleLabelKeep(t *testing.T) {
+	rule := compileRule(relabelRule{
+		Regex:  "^keep_.*$",
+		Action: relabelLabelKeep,
+	})
+
+	tags, keep := applyRelabelRule(map[string]string{"tmp_foo": "1", "keep_me": "2"}, rule)
+	if !keep {
+		t.Fatalf("labelkeep should never drop the metric itself")
+	}
+	if _, ok := tags["tmp_foo"]; ok {
+		t.Errorf("expected tmp_foo to be removed")
+	}
+	if _, ok := tags["keep_me"]; !ok {
+		t.Errorf("expected keep_me to survive")
+	}
+}
+
+func TestApplyRelabelRuleHashMod(t *testing.T) {
+	rule := compileRule(relabelRule{
+		SourceLabels: []string{"host"},
+		TargetLabel:  "shard",
+		Action:       relabelHashMod,
+		Modulus:      16,
+	})
+
+	tags, keep := applyRelabelRule(map[string]string{"host": "web1"}, rule)
+	if !keep {
+		t.Fatalf("hashmod should never drop a metric")
+	}
+	if tags["shard"] == "" {
+		t.Errorf("expected shard label to be set")
+	}
+
+	again, _ := applyRelabelRule(map[string]string{"host": "web1"}, rule)
+	if tags["shard"] != again["shard"] {
+		t.Errorf("expected hashmod to be deterministic, got %q then %q", tags["shard"], again["shard"])
+	}
+}
+
+// TestApplyRelabelingIsolatedByPath guards against two tasks with different
+// relabel_config files stepping on each other's ruleset: a reload for one path must
+// not affect metrics published under a different path.
+func TestApplyRelabelingIsolatedByPath(t *testing.T) {
+	rulesMu.Lock()
+	relabelRulesByPath["/etc/path-a.yml"] = []relabelRule{compileRule(relabelRule{
+		SourceLabels: []string{"env"},
+		Regex:        "prod",
+		Action:       relabelDrop,
+	})}
+	relabelRulesByPath["/etc/path-b.yml"] = nil
+	rulesMu.Unlock()
+	t.Cleanup(func() {
+		rulesMu.Lock()
+		delete(relabelRulesByPath, "/etc/path-a.yml")
+		delete(relabelRulesByPath, "/etc/path-b.yml")
+		rulesMu.Unlock()
+	})
+
+	configA := map[string]ctypes.ConfigValue{"relabel_config": ctypes.ConfigValueStr{Value: "/etc/path-a.yml"}}
+	configB := map[string]ctypes.ConfigValue{"relabel_config": ctypes.ConfigValueStr{Value: "/etc/path-b.yml"}}
+
+	if _, keep := applyRelabeling(map[string]string{"env": "prod"}, configA); keep {
+		t.Errorf("expected task A's drop rule to drop a prod metric")
+	}
+	if _, keep := applyRelabeling(map[string]string{"env": "prod"}, configB); !keep {
+		t.Errorf("expected task B, with no rules of its own, to keep the same metric unaffected by task A's rules")
+	}
+}
+
+func TestApplyRelabelRuleHashModZeroModulus(t *testing.T) {
+	rule := compileRule(relabelRule{
+		SourceLabels: []string{"host"},
+		TargetLabel:  "shard",
+		Action:       relabelHashMod,
+		Modulus:      0,
+	})
+
+	tags, keep := applyRelabelRule(map[string]string{"host": "web1"}, rule)
+	if !keep {
+		t.Fatalf("hashmod should never drop a metric")
+	}
+	if _, ok := tags["shard"]; ok {
+		t.Errorf("expected a zero modulus to leave tags untouched, got shard=%q", tags["shard"])
+	}
+}
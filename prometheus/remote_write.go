@@ -0,0 +1,124 @@
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+const (
+	modePushgateway = "pushgateway"
+	modeRemoteWrite = "remote_write"
+
+	remoteWriteVersion = "0.1.0"
+	userAgent          = "snap-plugin-publisher-prometheus"
+
+	// reservedNameLabel is the label Prometheus reserves for the metric name in a
+	// Remote Write TimeSeries.
+	reservedNameLabel = "__name__"
+)
+
+// publishMode returns the configured transport, defaulting to the legacy Pushgateway
+// behavior when "mode" is unset.
+func publishMode(config map[string]ctypes.ConfigValue) string {
+	v, ok := config["mode"]
+	if !ok {
+		return modePushgateway
+	}
+	str, ok := v.(ctypes.ConfigValueStr)
+	if !ok || str.Value == "" {
+		return modePushgateway
+	}
+	return str.Value
+}
+
+// buildWriteRequest converts decoded snap metrics into a Prometheus Remote Write 1.0
+// WriteRequest, reusing the same label synthesis mangleMetric already does for
+// Pushgateway, with the metric name carried as the reserved "__name__" label.
+func buildWriteRequest(metrics []plugin.MetricType, config map[string]ctypes.ConfigValue) (*prompb.WriteRequest, error) {
+	req := &prompb.WriteRequest{
+		Timeseries: make([]prompb.TimeSeries, 0, len(metrics)),
+	}
+
+	for _, m := range metrics {
+		name, tags, value, ts, keep := mangleMetric(m, config)
+		if !keep {
+			continue
+		}
+
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse value %q for metric %q as float64: %v", value, name, err)
+		}
+
+		labels := make([]prompb.Label, 0, len(tags)+1)
+		labels = append(labels, prompb.Label{Name: reservedNameLabel, Value: name})
+		for k, v := range tags {
+			labels = append(labels, prompb.Label{Name: k, Value: v})
+		}
+		// Remote Write requires labels to be sorted by name.
+		sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+		req.Timeseries = append(req.Timeseries, prompb.TimeSeries{
+			Labels:  labels,
+			Samples: []prompb.Sample{{Value: f, Timestamp: ts}},
+		})
+	}
+
+	return req, nil
+}
+
+// sendRemoteWriteMetrics serializes metrics as a snappy-compressed Remote Write 1.0
+// request and POSTs it to the configured URL, reusing the same pooled client and
+// retry/backoff loop as the Pushgateway transport.
+func sendRemoteWriteMetrics(config map[string]ctypes.ConfigValue,
+	promUrl *url.URL, client *clientConnection, metrics []plugin.MetricType) error {
+	logger := getLogger(config).With("url", promUrl.String())
+
+	writeReq, err := buildWriteRequest(metrics, config)
+	if err != nil {
+		logger.Error("error building Remote Write request", "error", err)
+		return err
+	}
+
+	data, err := proto.Marshal(writeReq)
+	if err != nil {
+		logger.Error("error marshaling Remote Write request", "error", err)
+		return err
+	}
+	compressed := snappy.Encode(nil, data)
+
+	req, err := http.NewRequest("POST", promUrl.String(), bytes.NewReader(compressed))
+	if err != nil {
+		logger.Error("error building Remote Write HTTP request", "error", err)
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", remoteWriteVersion)
+	req.Header.Set("User-Agent", userAgent)
+	client.Auth.applyAuth(req)
+
+	res, err := client.Conn.Do(req)
+	if err != nil {
+		logger.Error("error sending Remote Write request to Prometheus", "error", err)
+		return err
+	}
+	defer res.Body.Close()
+	if _, err := ioutil.ReadAll(res.Body); err != nil {
+		logger.Error("error getting Remote Write response", "error", err)
+		return err
+	}
+	return nil
+}
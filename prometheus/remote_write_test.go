@@ -0,0 +1,92 @@
+package prometheus
+
+import (
+	"testing"
+
+	"github.com/intelsdi-x/snap/control/plugin"
+	"github.com/intelsdi-x/snap/core/ctypes"
+)
+
+func TestBuildWriteRequest(t *testing.T) {
+	config := map[string]ctypes.ConfigValue{}
+	metrics := []plugin.MetricType{
+		newTestMetric([]string{"intel", "mock", "foo"}, map[string]string{"host": "web1"}, "", int64(42)),
+	}
+
+	req, err := buildWriteRequest(metrics, config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(req.Timeseries) != 1 {
+		t.Fatalf("expected 1 timeseries, got %d", len(req.Timeseries))
+	}
+
+	ts := req.Timeseries[0]
+	if len(ts.Samples) != 1 {
+		t.Fatalf("expected 1 sample, got %d", len(ts.Samples))
+	}
+	if ts.Samples[0].Value != 42 {
+		t.Errorf("expected value 42, got %v", ts.Samples[0].Value)
+	}
+	if ts.Samples[0].Timestamp != 1520879607789 {
+		t.Errorf("expected millisecond timestamp 1520879607789, got %d", ts.Samples[0].Timestamp)
+	}
+
+	var nameLabel string
+	for _, l := range ts.Labels {
+		if l.Name == reservedNameLabel {
+			nameLabel = l.Value
+		}
+	}
+	if nameLabel != "intel_mock_foo" {
+		t.Errorf("expected __name__=intel_mock_foo, got %q", nameLabel)
+	}
+
+	for i := 1; i < len(ts.Labels); i++ {
+		if ts.Labels[i-1].Name > ts.Labels[i].Name {
+			t.Fatalf("expected labels sorted by name, got %v", ts.Labels)
+		}
+	}
+}
+
+func TestBuildWriteRequestUnparsableValue(t *testing.T) {
+	config := map[string]ctypes.ConfigValue{}
+	metrics := []plugin.MetricType{
+		newTestMetric([]string{"intel", "mock", "foo"}, map[string]string{}, "", "not-a-number"),
+	}
+
+	if _, err := buildWriteRequest(metrics, config); err == nil {
+		t.Fatalf("expected an error for a non-numeric metric value")
+	}
+}
+
+func TestBuildWriteRequestDroppedMetricIsOmitted(t *testing.T) {
+	path := "/etc/remote-write-test-relabel.yml"
+	rulesMu.Lock()
+	relabelRulesByPath[path] = []relabelRule{compileRule(relabelRule{
+		SourceLabels: []string{"env"},
+		Regex:        "staging",
+		Action:       relabelDrop,
+	})}
+	rulesMu.Unlock()
+	t.Cleanup(func() {
+		rulesMu.Lock()
+		delete(relabelRulesByPath, path)
+		rulesMu.Unlock()
+	})
+
+	config := map[string]ctypes.ConfigValue{
+		"relabel_config": ctypes.ConfigValueStr{Value: path},
+	}
+	metrics := []plugin.MetricType{
+		newTestMetric([]string{"intel", "mock", "foo"}, map[string]string{"env": "staging"}, "", int64(1)),
+	}
+
+	req, err := buildWriteRequest(metrics, config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(req.Timeseries) != 0 {
+		t.Errorf("expected the dropped metric to be omitted, got %d timeseries", len(req.Timeseries))
+	}
+}